@@ -0,0 +1,971 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseCategoriesStrict(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string // Part of the expected error; empty if the file is valid.
+	}{
+		{"valid", "# Bills\n[Invoices]\nfatura\ncompress = true\n\n[Receipts]\nrecibo\n", ""},
+		{"byte order mark", "\ufeff[Invoices]\nfatura\n", ""},
+		{"keyword outside category", "fatura\n[Invoices]\n", "test.conf:1: \"fatura\" is outside of any category (-strict-config)"},
+		{"unknown setting", "[Invoices]\ncompres = true\n", "test.conf:2: unknown setting \"compres\""},
+		{"invalid setting", "[Invoices]\ndpi = 5000\n", "test.conf:2: invalid dpi value \"5000\": must be between 36 and 1200"},
+		{"duplicate category", "[Invoices]\nfatura\n[invoices]\n", "test.conf:3: category \"invoices\" was already defined on line 1"},
+		{"unclosed header", "[Invoices\n", "test.conf:1: category header \"[Invoices\" lacks its closing ]"},
+		{"text after header", "[Invoices] fatura\n", "test.conf:1: unexpected \" fatura\" after the category header"},
+		{"empty name", "[ ]\n", "test.conf:1: empty category name"},
+		{"parent folder", "[..]\n", "test.conf:1: category name \"..\" isn't a valid folder name"},
+		{"separator", "[Taxes/2024]\n", "test.conf:1: category name \"Taxes/2024\" contains a path separator"},
+		{"parent segment", "[../../etc]\n", "contains a path separator"},
+		{"absolute", "[/etc/cron.d]\n", "contains a path separator"},
+		{"backslash", "[..\\Windows]\n", "contains a path separator"},
+		{"control character", "[Invoices\x07]\n", "isn't a valid folder name"},
+		{"invalid UTF-8", "[Invoices]\nfatura \xff\n", "test.conf:2: invalid UTF-8"},
+		{"negative max_files", "[Invoices]\nmax_files = -1\n", "max_files must not be negative"},
+		{"negative max_size", "[Invoices]\nmax_size = -2GB\n", "invalid size"},
+		{"folder separator", "[Taxes]\nfolder.2024/Receipts = recibo\n", "test.conf:2: folder name \"2024/Receipts\" contains a path separator"},
+		{"folder parent", "[Taxes]\nfolder... = recibo\n", "folder name \"..\" isn't a valid folder name"},
+		{"folder control character", "[Taxes]\nfolder.Receipts\x07 = recibo\n", "folder name \"Receipts\\a\" isn't a valid folder name"},
+		{"empty folder name", "[Taxes]\nfolder. = recibo\n", "empty folder name"},
+		{"secret reference", "[Invoices]\nnotify = ${env:HOME}@example.com\n", "test.conf:2: secret references are only resolved in local categories files"},
+	}
+	// Warnings are logged.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			categories, err := parseCategories("test.conf", strings.NewReader(tt.config), true, false)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err == "" && len(categories) == 0:
+				t.Fatal("no categories parsed")
+			case tt.err != "" && err == nil:
+				t.Fatalf("expected error containing %q, got %d categories", tt.err, len(categories))
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("expected error containing %q, got %q", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestParseCategoriesLenient(t *testing.T) {
+	// Warnings are logged.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	config := "fatura\n[Invoices]\nfatura\ncompres = true\n[invoices]\nnota fiscal\n"
+	categories, err := parseCategories("test.conf", strings.NewReader(config), false, false)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(categories) != 2 {
+		t.Fatalf("expected 2 categories, got %d", len(categories))
+	}
+	// An unknown setting is taken as a keyword.
+	if got := strings.Join(categories[0].Keywords, "|"); got != "fatura|compres = true" {
+		t.Errorf("unexpected keywords %q", got)
+	}
+}
+
+func TestCheckCategoriesPIICategory(t *testing.T) {
+	defer func(detect bool, category string) { detectPII, piiCategory = detect, category }(detectPII, piiCategory)
+	detectPII = true
+	categories := []Category{{Name: "Invoices"}, {Name: "Private"}}
+	for _, tt := range []struct {
+		category string
+		ok       bool
+	}{{"Private", true}, {"Privte", false}, {"..", false}} {
+		piiCategory = tt.category
+		if err := checkCategories(categories); (err == nil) != tt.ok {
+			t.Errorf("-pii-category %q: unexpected result %v", tt.category, err)
+		}
+	}
+	for _, name := range []string{"..", "../Private", `..\Private`, ""} {
+		if checkCategoryName(name) == nil {
+			t.Errorf("-pii-category %q accepted", name)
+		}
+	}
+}
+
+// lineError matches the errors of parseCategories, which name the line they were found on.
+var lineError = regexp.MustCompile(`^fuzz\.conf:[1-9][0-9]*: `)
+
+func FuzzParseCategories(f *testing.F) {
+	f.Add("[Invoices]\nfatura\ncompress = true\nfolder.Paid = pago\n", true)
+	f.Add("fatura\n[Invoices]\ncompres = true\n[invoices]\n", false)
+	f.Add("[../etc]\n[C:]\n[a\\b]\n", false)
+	f.Add("\ufeff[Taxes]\nextract.cpf = \\d{3}\\.\\d{3}\nlayout = {year}/{seq}\n", true)
+	f.Add("[Invoices]\nnotify = ${file:/etc/passwd}\n", false)
+	log.SetOutput(io.Discard)
+	f.Fuzz(func(t *testing.T, config string, strict bool) {
+		categories, err := parseCategories("fuzz.conf", strings.NewReader(config), strict, false)
+		if err != nil {
+			if !lineError.MatchString(err.Error()) {
+				t.Fatalf("error doesn't name its line: %v", err)
+			}
+			return
+		}
+		for _, c := range categories {
+			if c.Name == "" || c.Name == "." || c.Name == ".." || strings.ContainsAny(c.Name, `/\[`) {
+				t.Fatalf("invalid category name %q accepted", c.Name)
+			}
+		}
+	})
+}
+
+func TestFdOpenedForWriting(t *testing.T) {
+	tests := []struct {
+		fdinfo string
+		want   bool
+	}{
+		{"pos:\t0\nflags:\t0100000\nmnt_id:\t29\n", false}, // O_RDONLY|O_LARGEFILE
+		{"pos:\t0\nflags:\t0100001\nmnt_id:\t29\n", true},  // O_WRONLY
+		{"pos:\t0\nflags:\t02100002\nmnt_id:\t29\n", true}, // O_RDWR|O_CLOEXEC
+		{"pos:\t0\nflags:\tgarbage\n", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := fdOpenedForWriting(tt.fdinfo); got != tt.want {
+			t.Errorf("fdOpenedForWriting(%q) = %t, want %t", tt.fdinfo, got, tt.want)
+		}
+	}
+}
+
+// installFakeTools puts stand-ins for pdftoppm, pdftotext and tesseract on the PATH, which take a
+// "PDF" to be its own text, so documents are classified without OCR.
+func installFakeTools(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake tools are shell scripts")
+	}
+	dir := t.TempDir()
+	scripts := map[string]string{
+		// pdftoppm [options] <pdf> <prefix>
+		"pdftoppm": `for a; do pdf=$prev; prev=$a; done; cp "$pdf" "$prev-1.png"`,
+		// pdftotext [options] <pdf> <out>
+		"pdftotext": `for a; do pdf=$prev; prev=$a; done; if [ "$prev" = - ]; then cat "$pdf"; else cp "$pdf" "$prev"; fi`,
+		// tesseract <image> <outbase|stdout> [options] [configs]
+		"tesseract": `case "$1" in --version) echo "tesseract 5.3.0"; exit 0;; --list-langs) printf 'List of available languages (2):\neng\npor\n'; exit 0;; esac
+if [ "$2" = stdout ]; then cat "$1"; exit 0; fi
+cat "$1" > "$2.txt"
+awk 'BEGIN{OFS="\t"; print "level","page_num","block_num","par_num","line_num","word_num","left","top","width","height","conf","text"} {for (i=1;i<=NF;i++) print 5,1,1,1,NR,i,10*i,30*NR,50,20,91.5,$i}' "$1" > "$2.tsv"`,
+	}
+	for name, script := range scripts {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("#!/bin/sh\n"+script+"\n"), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	pdftoppm, tesseract := pdftoppmPath, tesseractPath
+	t.Cleanup(func() { pdftoppmPath, tesseractPath = pdftoppm, tesseract })
+	pdftoppmPath, tesseractPath = filepath.Join(dir, "pdftoppm"), filepath.Join(dir, "tesseract")
+}
+
+// quietLog discards the log output of the test.
+func quietLog(t *testing.T) {
+	w := log.Writer()
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(w) })
+}
+
+// testRoot returns a destination root in a temporary directory, classifying "fatura" as Invoices
+// and "recibo" as Receipts.
+func testRoot(t *testing.T) *destRoot {
+	dir := t.TempDir()
+	return &destRoot{
+		Dir:        filepath.Join(dir, "out"),
+		IndexPath:  filepath.Join(dir, ".pdforganizer-index.json"),
+		Categories: []Category{{Name: "Invoices", Keywords: []string{"fatura"}}, {Name: "Receipts", Keywords: []string{"recibo"}}},
+		Index:      &fileState{Files: map[string]*fileRecord{}},
+	}
+}
+
+// useDefaults sets the options processFile depends on to their defaults, which main sets from the flags,
+// and restores them after the test.
+func useDefaults(t *testing.T) {
+	layout, source, sources, dupMode, dupTo, suffix, timeout := folderLayout, dateSource, dateSources, duplicateMode, duplicatesTo, suffixMode, ocrTimeout
+	t.Cleanup(func() {
+		folderLayout, dateSource, dateSources, duplicateMode, duplicatesTo, suffixMode, ocrTimeout = layout, source, sources, dupMode, dupTo, suffix, timeout
+	})
+	folderLayout, dateSource, duplicateMode, duplicatesTo, suffixMode, ocrTimeout = "{category}", "scanned", "report", "inbox", "counter", time.Minute
+	var err error
+	if dateSources, err = parseDateSources(dateSource); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeZip creates the ZIP archive at path holding files, by name.
+func writeZip(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := zip.NewWriter(f)
+	for name, content := range files {
+		entry, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry.Write([]byte(content))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+}
+
+func TestInPlaceLeavesOfficeAndArchives(t *testing.T) {
+	installFakeTools(t)
+	quietLog(t)
+	defer func(mode bool, command string) { inPlace, converter = mode, command }(inPlace, converter)
+	inPlace = true
+	// A converter that succeeds, so nothing but -in-place keeps the documents from being ingested.
+	converter = "cp"
+	root := testRoot(t)
+	dir := t.TempDir()
+
+	doc := filepath.Join(dir, "report.docx")
+	if err := os.WriteFile(doc, []byte("%PDF-1.4\nfatura\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ingestOffice(doc, info, root); err != nil {
+		t.Fatalf("ingestOffice: %v", err)
+	}
+	if _, err := os.Stat(doc); err != nil {
+		t.Errorf("office document gone after -in-place: %v", err)
+	}
+
+	archive := filepath.Join(dir, "bank.zip")
+	writeZip(t, archive, map[string]string{"statement.pdf": "%PDF-1.4\nfatura\n"})
+	if err := ingestArchive(archive, root); err != nil {
+		t.Fatalf("ingestArchive: %v", err)
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Errorf("archive gone after -in-place: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("expected only the document and the archive, found %d entries", len(entries))
+	}
+}
+
+func TestArchiveRetriesOnlyFailedDocuments(t *testing.T) {
+	installFakeTools(t)
+	quietLog(t)
+	useDefaults(t)
+	defer func(n int, f []fileFailure) { processedFiles, failures = n, f }(processedFiles, failures)
+	root := testRoot(t)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "bank.zip")
+	writeZip(t, archive, map[string]string{"a.pdf": "%PDF-1.4\nfatura\n", "b.pdf": "%PDF-1.4\nrecibo\n"})
+
+	// A file in the way of the Receipts folder fails b.pdf.
+	if err := os.MkdirAll(root.Dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	blocker := filepath.Join(root.Dir, "Receipts")
+	if err := os.WriteFile(blocker, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	failures = nil
+	if err := ingestArchive(archive, root); err != nil {
+		t.Fatalf("first run: %v", err)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("expected 1 failure, got %v", failures)
+	}
+	if _, err := os.Stat(archive); err != nil {
+		t.Fatalf("archive with a failed document removed: %v", err)
+	}
+	if rec := root.Index.Archives[archive]; rec == nil || len(rec.Filed) != 1 || rec.Filed[0] != "a.pdf" {
+		t.Fatalf("unexpected progress %+v", rec)
+	}
+
+	os.Remove(blocker)
+	failures = nil
+	if err := ingestArchive(archive, root); err != nil {
+		t.Fatalf("second run: %v", err)
+	}
+	if len(failures) != 0 {
+		t.Fatalf("unexpected failures %v", failures)
+	}
+	if _, err := os.Stat(archive); !os.IsNotExist(err) {
+		t.Errorf("archive not removed after all documents were filed: %v", err)
+	}
+	if root.Index.Archives[archive] != nil {
+		t.Error("progress of a removed archive kept")
+	}
+	invoices, _ := os.ReadDir(filepath.Join(root.Dir, "Invoices"))
+	receipts, _ := os.ReadDir(filepath.Join(root.Dir, "Receipts"))
+	if len(invoices) != 1 || len(receipts) != 1 {
+		t.Errorf("expected one document per category, got %d invoices and %d receipts", len(invoices), len(receipts))
+	}
+}
+
+func TestKeptArchiveIsRecorded(t *testing.T) {
+	installFakeTools(t)
+	quietLog(t)
+	useDefaults(t)
+	defer func(n int, f []fileFailure) { processedFiles, failures = n, f }(processedFiles, failures)
+	root := testRoot(t)
+	// An archive in a folder of its own name isn't taken for a kept one.
+	dir := filepath.Join(t.TempDir(), "Bank")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "Bank.zip")
+	writeZip(t, archive, map[string]string{"a.pdf": "%PDF-1.4\nfatura\n", "statement.ofx": "<OFX>"})
+	info, err := os.Stat(archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if root.Index.keptArchive(archive, info) {
+		t.Fatal("new archive taken for a kept one")
+	}
+	if err := ingestArchive(archive, root); err != nil {
+		t.Fatal(err)
+	}
+	kept := filepath.Join(dir, "Bank", "Bank.zip")
+	info, err = os.Stat(kept)
+	if err != nil {
+		t.Fatalf("archive with an OFX file not kept: %v", err)
+	}
+	if !root.Index.keptArchive(kept, info) {
+		t.Error("kept archive not recorded")
+	}
+	// A changed archive is extracted again.
+	writeZip(t, kept, map[string]string{"b.pdf": "%PDF-1.4\nrecibo\n", "statement.ofx": "<OFX>"})
+	os.Chtimes(kept, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	if info, _ = os.Stat(kept); root.Index.keptArchive(kept, info) {
+		t.Error("changed archive taken for the kept one")
+	}
+}
+
+// controlClients returns the number of clients connected to the control socket.
+func controlClients() int {
+	control.Lock()
+	defer control.Unlock()
+	return len(control.clients)
+}
+
+// waitFor fails the test unless cond becomes true within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Unix sockets")
+	}
+	quietLog(t)
+	path := filepath.Join(t.TempDir(), "ctl.sock")
+	if err := startControlSocket(path, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket permissions: %v %v", info.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+		t.Errorf("expected only the socket, found %d entries", len(entries))
+	}
+
+	t.Run("commands", func(t *testing.T) {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		events := bufio.NewScanner(conn)
+		expect := func(command, event string) {
+			t.Helper()
+			conn.Write([]byte(`{"command":"` + command + `"}` + "\n"))
+			if !events.Scan() {
+				t.Fatalf("%s: no event: %v", command, events.Err())
+			}
+			var got controlEvent
+			if err := json.Unmarshal(events.Bytes(), &got); err != nil || got.Event != event {
+				t.Fatalf("%s: expected %s event, got %s (%v)", command, event, events.Text(), err)
+			}
+		}
+		expect("pause", "paused")
+		resumed := make(chan struct{})
+		go func() {
+			waitWhilePaused()
+			close(resumed)
+		}()
+		expect("resume", "resumed")
+		select {
+		case <-resumed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("still paused after resume")
+		}
+		expect("bogus", "error")
+	})
+	waitFor(t, "the client to disconnect", func() bool { return controlClients() == 0 })
+
+	t.Run("stalled client", func(t *testing.T) {
+		// A client that never reads its events is dropped instead of blocking the organizer.
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		waitFor(t, "the client to connect", func() bool { return controlClients() == 1 })
+		done := make(chan struct{})
+		go func() {
+			for i := 0; i < 20000; i++ {
+				emitEvent(controlEvent{Event: "document", Detail: strings.Repeat("x", 1000)})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("events blocked by a client that doesn't read them")
+		}
+		waitFor(t, "the stalled client to be dropped", func() bool { return controlClients() == 0 })
+	})
+}
+
+func TestHealthStatsRequireAdmin(t *testing.T) {
+	defer func(path string) { indexPath = path }(indexPath)
+	indexPath = filepath.Join(t.TempDir(), ".pdforganizer-index.json")
+	get := func(handler http.Handler, path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		if key != "" {
+			r.Header.Set("Authorization", "Bearer "+key)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	open := healthHandler(nil)
+	if w := get(open, "/healthz", ""); w.Code != http.StatusOK {
+		t.Errorf("/healthz: status %d", w.Code)
+	}
+	if w := get(open, "/stats", ""); w.Code != http.StatusNotFound {
+		t.Errorf("/stats without -serve-auth: status %d, want 404", w.Code)
+	}
+
+	creds := []serveCredential{{Role: roleUpload, Key: "upload-key"}, {Role: roleAdmin, Key: "admin-key"}}
+	guarded := healthHandler(creds)
+	for _, tt := range []struct {
+		key  string
+		want int
+	}{{"", http.StatusUnauthorized}, {"wrong", http.StatusUnauthorized}, {"upload-key", http.StatusForbidden}, {"admin-key", http.StatusOK}} {
+		if w := get(guarded, "/stats", tt.key); w.Code != tt.want {
+			t.Errorf("/stats with key %q: status %d, want %d", tt.key, w.Code, tt.want)
+		}
+	}
+}
+
+func TestCheckQuotasCountsIndexedDocuments(t *testing.T) {
+	quietLog(t)
+	root := testRoot(t)
+	root.Categories[0].MaxFiles = 2
+	root.Categories[1].MaxSize = 1 << 10
+	// With a layout, documents aren't in a folder named after their category.
+	for i, rec := range []fileRecord{
+		{Category: "Invoices", Size: 100},
+		{Category: "Invoices", Size: 100},
+		{Category: "Invoices", Size: 100},
+		{Category: "Receipts", Size: 1000},
+		{Size: 1 << 20},
+	} {
+		rec := rec
+		rec.Path = filepath.Join(root.Dir, "2024", rec.Category, fmt.Sprintf("%d.pdf", i))
+		root.Index.Files[rec.Path] = &rec
+		// Saving the index drops the records of missing files.
+		if err := os.MkdirAll(filepath.Dir(rec.Path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(rec.Path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkQuotas([]*destRoot{root})
+	if want := []string{"Invoices exceeded 2 documents"}; !equalStrings(root.Index.Alerts, want) {
+		t.Fatalf("alerts %q, want %q", root.Index.Alerts, want)
+	}
+
+	path := filepath.Join(root.Dir, "2024", "Receipts", "5.pdf")
+	if err := os.WriteFile(path, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root.Index.Files[path] = &fileRecord{Path: path, Category: "Receipts", Size: 100}
+	checkQuotas([]*destRoot{root})
+	if want := []string{"Invoices exceeded 2 documents", "Receipts exceeded 1.0 KB"}; !equalStrings(root.Index.Alerts, want) {
+		t.Fatalf("alerts %q, want %q", root.Index.Alerts, want)
+	}
+}
+
+func TestTracesArePerDocument(t *testing.T) {
+	installFakeTools(t)
+	quietLog(t)
+	useDefaults(t)
+	defer func(n int, f []fileFailure) { processedFiles, failures = n, f }(processedFiles, failures)
+	var mu sync.Mutex
+	var names []string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			ResourceSpans []struct {
+				ScopeSpans []struct {
+					Spans []struct{ Name string }
+				}
+			}
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("decoding trace: %v", err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, rs := range body.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}))
+	defer collector.Close()
+	defer func(endpoint string) { traceEndpoint = endpoint }(traceEndpoint)
+	traceEndpoint = collector.URL
+
+	// Documents OCR'd concurrently, as by -ocr-workers or the serve command, each get their own spans.
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("%d.pdf", i))
+		if err := os.WriteFile(path, []byte("%PDF-1.4\nfatura\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ocr, err := extractOCR(path, "por")
+			if err != nil {
+				t.Errorf("extractOCR: %v", err)
+				return
+			}
+			if len(ocr.Spans) != 2 || ocr.Spans[0].Name != "render" || ocr.Spans[1].Name != "ocr" {
+				t.Errorf("%s: unexpected spans %v", path, ocr.Spans)
+			}
+		}()
+	}
+	wg.Wait()
+
+	root := testRoot(t)
+	path := filepath.Join(dir, "0.pdf")
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filed := processFile(path, info, root); filed == "" {
+		t.Fatal("document not filed")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"document", "render", "ocr", "classify", "move"}; !equalStrings(names, want) {
+		t.Errorf("exported spans %q, want %q", names, want)
+	}
+}
+
+func TestParseCron(t *testing.T) {
+	tests := []struct {
+		expr           string
+		err            string // Part of the expected error; empty if the expression is valid.
+		domAny, dowAny bool
+	}{
+		{"*/15 * * * *", "", true, true},
+		{"@Daily", "", true, true},
+		{"0 9 * * mon-fri", "", true, false},
+		{"0 0 1,15 jan,jul *", "", false, true},
+		{"0 0 */1 * 1-5", "", true, false},
+		{"0 0 1-31 * 1", "", true, false},
+		{"0 0 13 * 0-6", "", false, true},
+		{"0 0 13 * 1-7", "", false, true},
+		{"0 0 */2 * *", "", false, true},
+		{"* * * *", "expected minute, hour, day of month, month and day of week", false, false},
+		{"60 * * * *", "must be between 0 and 59", false, false},
+		{"0 0 0 * *", "must be between 1 and 31", false, false},
+		{"*/0 * * * *", "invalid schedule step", false, false},
+		{"0 0 10-5 * *", "invalid schedule range", false, false},
+		{"0 0 * * funday", "invalid schedule value \"funday\"", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && err == nil:
+				t.Fatalf("expected error containing %q", tt.err)
+			case tt.err != "" && !strings.Contains(err.Error(), tt.err):
+				t.Fatalf("expected error containing %q, got %q", tt.err, err)
+			case tt.err == "" && (s.domAny != tt.domAny || s.dowAny != tt.dowAny):
+				t.Fatalf("domAny, dowAny = %v, %v, want %v, %v", s.domAny, s.dowAny, tt.domAny, tt.dowAny)
+			}
+		})
+	}
+	// Sunday is both 0 and 7.
+	if s, err := parseCron("0 0 * * 7"); err != nil || s.dow&1 == 0 {
+		t.Errorf("day of week 7 isn't Sunday: %v", err)
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	monday := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	tests := []struct {
+		expr string
+		from time.Time
+		want time.Time // Zero if the schedule never matches.
+	}{
+		{"*/15 * * * *", monday, time.Date(2024, 1, 1, 10, 45, 0, 0, time.UTC)},
+		{"*/15 * * * *", monday.Add(15 * time.Minute), time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{"@daily", monday, time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", monday, time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * mon-fri", time.Date(2024, 1, 5, 10, 30, 0, 0, time.UTC), time.Date(2024, 1, 8, 9, 0, 0, 0, time.UTC)},
+		{"0 12 * * 7", monday, time.Date(2024, 1, 7, 12, 0, 0, 0, time.UTC)},
+		{"0 0 13 * *", monday, time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		// When both day fields are restricted, a day matching either of them matches.
+		{"0 0 13 * fri", monday, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 3 * fri", monday, time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC)},
+		// A field matching every day is unrestricted however it's written, so the other one decides.
+		{"0 0 1-31 * fri", monday, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 */1 * fri", monday, time.Date(2024, 1, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 13 * 0-6", monday, time.Date(2024, 1, 13, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", monday, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 30 2 *", monday, time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			s, err := parseCron(tt.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := s.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%s) = %s, want %s", tt.from.Format(time.RFC3339), got.Format(time.RFC3339), tt.want.Format(time.RFC3339))
+			}
+		})
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	creds := []serveCredential{
+		{Role: roleUpload, Key: "upload-key"},
+		{Role: roleAdmin, Key: "admin-key"},
+		{Role: roleAdmin, User: "alice", Password: "secret"},
+		{Role: roleUpload, User: "bob", Password: "hunter2"},
+	}
+	tests := []struct {
+		name   string
+		header map[string]string
+		user   string // Basic authentication, with password, if set.
+		pass   string
+		role   string
+	}{
+		{"no credentials", nil, "", "", ""},
+		{"bearer key", map[string]string{"Authorization": "Bearer upload-key"}, "", "", roleUpload},
+		{"api key header", map[string]string{"X-API-Key": "admin-key"}, "", "", roleAdmin},
+		{"wrong key", map[string]string{"Authorization": "Bearer admin-key2"}, "", "", ""},
+		{"empty bearer", map[string]string{"Authorization": "Bearer "}, "", "", ""},
+		{"user", nil, "alice", "secret", roleAdmin},
+		{"wrong password", nil, "alice", "hunter2", ""},
+		{"password as key", map[string]string{"X-API-Key": "secret"}, "", "", ""},
+		{"upload user", nil, "bob", "hunter2", roleUpload},
+		// When several credentials are sent, the highest role they grant counts.
+		{"key and user", map[string]string{"X-API-Key": "upload-key"}, "alice", "secret", roleAdmin},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/stats", nil)
+			for key, value := range tt.header {
+				r.Header.Set(key, value)
+			}
+			if tt.user != "" {
+				r.SetBasicAuth(tt.user, tt.pass)
+			}
+			if role := authorize(r, creds); role != tt.role {
+				t.Errorf("role %q, want %q", role, tt.role)
+			}
+		})
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	creds := []serveCredential{{Role: roleUpload, Key: "upload-key"}, {Role: roleAdmin, Key: "admin-key"}}
+	ok := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }
+	tests := []struct {
+		role, key string
+		status    int
+	}{
+		{roleUpload, "", http.StatusUnauthorized},
+		{roleUpload, "wrong", http.StatusUnauthorized},
+		{roleUpload, "upload-key", http.StatusOK},
+		{roleUpload, "admin-key", http.StatusOK},
+		{roleAdmin, "", http.StatusUnauthorized},
+		{roleAdmin, "upload-key", http.StatusForbidden},
+		{roleAdmin, "admin-key", http.StatusOK},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		w := httptest.NewRecorder()
+		requireRole(tt.role, creds, ok)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s endpoint with key %q: status %d, want %d", tt.role, tt.key, w.Code, tt.status)
+		}
+		if tt.status == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s endpoint with key %q: no WWW-Authenticate header", tt.role, tt.key)
+		}
+		if tt.status == http.StatusOK && w.Body.String() != "ok" {
+			t.Errorf("%s endpoint with key %q: handler not called", tt.role, tt.key)
+		}
+	}
+}
+
+// useTransaction starts a -transactional run with its index and journal in a temporary directory,
+// returning the directory, and restores the options afterwards.
+func useTransaction(t *testing.T, id string) string {
+	dir := t.TempDir()
+	index, txn, roots, shared, key := indexPath, txnID, txnRoots, sharedMode, journalKey
+	t.Cleanup(func() { indexPath, txnID, txnRoots, sharedMode, journalKey = index, txn, roots, shared, key })
+	indexPath, txnID, txnRoots, sharedMode, journalKey = filepath.Join(dir, ".pdforganizer-index.json"), id, nil, false, nil
+	if err := os.MkdirAll(filepath.Join(dir, "out"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// stageTestFile creates the document in/name in dir and stages its move to out/name, returning both paths.
+func stageTestFile(t *testing.T, dir, name string) (src, dst string) {
+	src, dst = filepath.Join(dir, "in", name), filepath.Join(dir, "out", name)
+	if err := os.MkdirAll(filepath.Dir(src), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(src, []byte("%PDF-1.4\n"+name+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := stageFile(src, dst); err != nil {
+		t.Fatalf("stageFile: %v", err)
+	}
+	return src, dst
+}
+
+// testTransaction returns the journal entries of the transaction id and the journals recording it.
+func testTransaction(t *testing.T, id string) ([]journalEntry, []string) {
+	txns, journals, err := readTransactions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return txns[id], journals[id]
+}
+
+// exists reports whether a file is at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+func TestCommitTransaction(t *testing.T) {
+	quietLog(t)
+	dir := useTransaction(t, "20240101-100000.000000000")
+	a, aCopy := stageTestFile(t, dir, "a.pdf")
+	b, bCopy := stageTestFile(t, dir, "b.pdf")
+	if !exists(a) || !exists(b) {
+		t.Fatal("originals removed before the commit")
+	}
+	txn, journals := testTransaction(t, txnID)
+	if err := commitTransaction(txnID, txn, journals); err != nil {
+		t.Fatalf("commitTransaction: %v", err)
+	}
+	if exists(a) || exists(b) || !exists(aCopy) || !exists(bCopy) {
+		t.Error("originals not replaced by their copies")
+	}
+	txn, _ = testTransaction(t, txnID)
+	if committed, rolledBack, staged := transactionState(txn); !committed || rolledBack || staged != 2 {
+		t.Errorf("state committed %v, rolled back %v, staged %d", committed, rolledBack, staged)
+	}
+}
+
+func TestCommitTransactionRejectsChangedOriginal(t *testing.T) {
+	quietLog(t)
+	dir := useTransaction(t, "20240101-100000.000000000")
+	a, aCopy := stageTestFile(t, dir, "a.pdf")
+	if err := os.WriteFile(a, []byte("%PDF-1.4\nrescanned\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	txn, journals := testTransaction(t, txnID)
+	if err := commitTransaction(txnID, txn, journals); err == nil || !strings.Contains(err.Error(), "changed or disappeared") {
+		t.Fatalf("expected the changed original to fail the commit, got %v", err)
+	}
+	if !exists(a) || !exists(aCopy) {
+		t.Error("files removed by a failed commit")
+	}
+	txn, _ = testTransaction(t, txnID)
+	if committed, _, _ := transactionState(txn); committed {
+		t.Error("failed commit recorded")
+	}
+}
+
+func TestRollbackTransaction(t *testing.T) {
+	quietLog(t)
+	dir := useTransaction(t, "20240101-100000.000000000")
+	a, aCopy := stageTestFile(t, dir, "a.pdf")
+	b, bCopy := stageTestFile(t, dir, "b.pdf")
+	// A copy whose original disappeared is the only one left, so it's kept.
+	if err := os.Remove(b); err != nil {
+		t.Fatal(err)
+	}
+	txn, journals := testTransaction(t, txnID)
+	if err := rollbackTransaction(txnID, txn, journals); err != nil {
+		t.Fatalf("rollbackTransaction: %v", err)
+	}
+	if !exists(a) || exists(aCopy) {
+		t.Error("staged copy not removed")
+	}
+	if !exists(bCopy) {
+		t.Error("copy of a missing original removed")
+	}
+	txn, _ = testTransaction(t, txnID)
+	if committed, rolledBack, _ := transactionState(txn); committed || !rolledBack {
+		t.Errorf("state committed %v, rolled back %v", committed, rolledBack)
+	}
+}
+
+func TestRecoverTransactions(t *testing.T) {
+	quietLog(t)
+	defer func(out *os.File) { os.Stdout = out }(os.Stdout)
+	os.Stdout, _ = os.Open(os.DevNull)
+
+	// An interrupted run that didn't record its commit is rolled back.
+	dir := useTransaction(t, "20240101-100000.000000000")
+	a, aCopy := stageTestFile(t, dir, "a.pdf")
+	txnID = ""
+	if err := recoverTransactions(); err != nil {
+		t.Fatalf("recoverTransactions: %v", err)
+	}
+	if !exists(a) || exists(aCopy) {
+		t.Error("interrupted transaction not rolled back")
+	}
+
+	// One interrupted after recording its commit is completed.
+	txnID = "20240101-110000.000000000"
+	b, bCopy := stageTestFile(t, dir, "b.pdf")
+	if err := endTransaction(txnID, "commit", []string{journalFor(indexPath)}); err != nil {
+		t.Fatal(err)
+	}
+	txnID = ""
+	if err := recoverTransactions(); err != nil {
+		t.Fatalf("recoverTransactions: %v", err)
+	}
+	if exists(b) || !exists(bCopy) {
+		t.Error("committed transaction not completed")
+	}
+	// The rolled back transaction isn't undone again.
+	if !exists(a) {
+		t.Error("original of a rolled back transaction removed")
+	}
+}
+
+func TestMoveToCategorySuffixes(t *testing.T) {
+	quietLog(t)
+	defer func(mode string, names *nameHistory) { suffixMode, usedNames = mode, names }(suffixMode, usedNames)
+	usedNames = &nameHistory{used: make(map[string]bool), highest: make(map[string]int)}
+
+	// move files a document with content into dir as a.pdf, returning the name it got.
+	move := func(t *testing.T, dir, content string) string {
+		src := filepath.Join(t.TempDir(), "scan.pdf")
+		if err := os.WriteFile(src, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		path, err := moveToCategory(src, dir, "a.pdf")
+		if err != nil {
+			t.Fatalf("moveToCategory: %v", err)
+		}
+		if exists(src) {
+			t.Errorf("%s not moved", src)
+		}
+		return filepath.Base(path)
+	}
+	check := func(t *testing.T, got, want string) {
+		t.Helper()
+		if got != want {
+			t.Errorf("filed as %q, want %q", got, want)
+		}
+	}
+
+	t.Run("counter", func(t *testing.T) {
+		suffixMode = "counter"
+		dir := t.TempDir()
+		check(t, move(t, dir, "one"), "a.pdf")
+		check(t, move(t, dir, "two"), "a (1).pdf")
+		check(t, move(t, dir, "three"), "a (2).pdf")
+		// The lowest free counter is taken again.
+		if err := os.Remove(filepath.Join(dir, "a (1).pdf")); err != nil {
+			t.Fatal(err)
+		}
+		check(t, move(t, dir, "four"), "a (1).pdf")
+	})
+
+	t.Run("monotonic", func(t *testing.T) {
+		suffixMode = "monotonic"
+		dir := t.TempDir()
+		// As loaded from the journal: a.pdf and a (3).pdf were filed once and have since been removed.
+		usedNames.note(filepath.Join(dir, "a.pdf"))
+		usedNames.note(filepath.Join(dir, "a (3).pdf"))
+		check(t, move(t, dir, "one"), "a (4).pdf")
+		check(t, move(t, dir, "two"), "a (5).pdf")
+		// Unlike with counters, a name freed again isn't reused.
+		if err := os.Remove(filepath.Join(dir, "a (5).pdf")); err != nil {
+			t.Fatal(err)
+		}
+		check(t, move(t, dir, "three"), "a (6).pdf")
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		suffixMode = "hash"
+		dir := t.TempDir()
+		check(t, move(t, dir, "one"), "a.pdf")
+		hash := sha256.Sum256([]byte("two"))
+		named := fmt.Sprintf("a (%x).pdf", hash[:4])
+		check(t, move(t, dir, "two"), named)
+		// Only identical copies still need a counter.
+		check(t, move(t, dir, "two"), strings.TrimSuffix(named, ".pdf")+" (1).pdf")
+	})
+}